@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// seqIndex is the membership index buildMask and Remove need over the set
+// of cache positions a sequence currently owns. It is kept behind an
+// interface so the sparse word-bitmap implementation below can later be
+// swapped for a compressed roaring-bitmap library without touching Simple.
+type seqIndex interface {
+	Set(pos int)
+	// Range calls f, in increasing order, with every set position in
+	// [begin, end).
+	Range(begin, end int, f func(pos int))
+	// AndNotRange clears every position in [begin, end).
+	AndNotRange(begin, end int)
+}
+
+// wordBitmap is a sparse, word-compressed bitmap: only the 64-bit words that
+// contain at least one set bit are stored, and order keeps their indices
+// sorted so Range/AndNotRange can binary-search directly to the first word
+// that might overlap [begin, end) and then step only across words that
+// actually hold a bit, rather than walking every word index the range
+// spans. Cost is therefore proportional to the number of set bits (plus the
+// occupied words touched), not to end-begin: a sequence whose positions
+// have become sparse relative to a long-running cache's overall range (for
+// example, after AndNotRange has punched holes through most of it) no
+// longer pays for the empty stretches between them.
+type wordBitmap struct {
+	words map[int]uint64
+	// order holds the keys of words in ascending order, kept in sync with
+	// it on every insertion/removal.
+	order []int
+}
+
+func newSeqIndex() seqIndex {
+	return &wordBitmap{words: make(map[int]uint64)}
+}
+
+func (b *wordBitmap) Set(pos int) {
+	wi := pos / 64
+
+	if _, ok := b.words[wi]; !ok {
+		i := sort.SearchInts(b.order, wi)
+		b.order = append(b.order, 0)
+		copy(b.order[i+1:], b.order[i:])
+		b.order[i] = wi
+	}
+
+	b.words[wi] |= 1 << uint(pos%64)
+}
+
+func (b *wordBitmap) Range(begin, end int, f func(pos int)) {
+	if begin >= end {
+		return
+	}
+
+	lo, hi := begin/64, (end-1)/64
+
+	for i := sort.SearchInts(b.order, lo); i < len(b.order) && b.order[i] <= hi; i++ {
+		wi := b.order[i]
+		w := b.words[wi]
+		base := wi * 64
+
+		for w != 0 {
+			bit := bits.TrailingZeros64(w)
+			w &^= 1 << uint(bit)
+
+			if pos := base + bit; pos >= begin && pos < end {
+				f(pos)
+			}
+		}
+	}
+}
+
+func (b *wordBitmap) AndNotRange(begin, end int) {
+	if begin >= end {
+		return
+	}
+
+	lo, hi := begin/64, (end-1)/64
+
+	for i := sort.SearchInts(b.order, lo); i < len(b.order) && b.order[i] <= hi; {
+		wi := b.order[i]
+		base := wi * 64
+
+		bitLo, bitHi := 0, 64
+		if begin > base {
+			bitLo = begin - base
+		}
+		if end < base+64 {
+			bitHi = end - base
+		}
+
+		b.words[wi] &^= bitRangeMask(bitLo, bitHi)
+
+		if b.words[wi] == 0 {
+			delete(b.words, wi)
+			b.order = append(b.order[:i], b.order[i+1:]...)
+		} else {
+			i++
+		}
+	}
+}
+
+// bitRangeMask returns a uint64 with bits [lo, hi) set, for 0 <= lo <= hi <= 64.
+func bitRangeMask(lo, hi int) uint64 {
+	if lo >= hi {
+		return 0
+	}
+
+	m := ^uint64(0) << uint(lo)
+	if hi < 64 {
+		m &^= ^uint64(0) << uint(hi)
+	}
+
+	return m
+}
@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// reference is a naive, obviously-correct map-based model of seqIndex used
+// to check wordBitmap's behavior against.
+type reference struct {
+	set map[int]bool
+}
+
+func (r *reference) Set(pos int)              { r.set[pos] = true }
+func (r *reference) AndNotRange(begin, end int) {
+	for pos := range r.set {
+		if pos >= begin && pos < end {
+			delete(r.set, pos)
+		}
+	}
+}
+func (r *reference) Range(begin, end int, f func(pos int)) {
+	positions := make([]int, 0, len(r.set))
+	for pos := range r.set {
+		if pos >= begin && pos < end {
+			positions = append(positions, pos)
+		}
+	}
+	for i := 0; i < len(positions); i++ {
+		for j := i + 1; j < len(positions); j++ {
+			if positions[j] < positions[i] {
+				positions[i], positions[j] = positions[j], positions[i]
+			}
+		}
+	}
+	for _, pos := range positions {
+		f(pos)
+	}
+}
+
+func TestWordBitmapMatchesReference(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+
+	bm := newSeqIndex().(*wordBitmap)
+	ref := &reference{set: make(map[int]bool)}
+
+	const space = 4096
+	for op := 0; op < 2000; op++ {
+		switch rng.Intn(3) {
+		case 0:
+			pos := rng.Intn(space)
+			bm.Set(pos)
+			ref.Set(pos)
+		case 1, 2:
+			begin := rng.Intn(space)
+			end := begin + rng.Intn(space-begin+1)
+
+			var gotPositions, wantPositions []int
+			bm.Range(begin, end, func(pos int) { gotPositions = append(gotPositions, pos) })
+			ref.Range(begin, end, func(pos int) { wantPositions = append(wantPositions, pos) })
+
+			if len(gotPositions) != len(wantPositions) {
+				t.Fatalf("Range(%v,%v): got %v, want %v", begin, end, gotPositions, wantPositions)
+			}
+			for i := range gotPositions {
+				if gotPositions[i] != wantPositions[i] {
+					t.Fatalf("Range(%v,%v): got %v, want %v", begin, end, gotPositions, wantPositions)
+				}
+			}
+
+			if op%5 == 0 {
+				bm.AndNotRange(begin, end)
+				ref.AndNotRange(begin, end)
+			}
+		}
+	}
+}
+
+func TestWordBitmapOrderStaysSortedAndInSyncWithWords(t *testing.T) {
+	bm := newSeqIndex().(*wordBitmap)
+
+	for _, pos := range []int{500, 10, 300, 10, 70, 900} {
+		bm.Set(pos)
+	}
+
+	if len(bm.order) != len(bm.words) {
+		t.Fatalf("order has %v entries, words has %v", len(bm.order), len(bm.words))
+	}
+	for i := 1; i < len(bm.order); i++ {
+		if bm.order[i-1] >= bm.order[i] {
+			t.Fatalf("order not strictly increasing: %v", bm.order)
+		}
+	}
+	for _, wi := range bm.order {
+		if _, ok := bm.words[wi]; !ok {
+			t.Fatalf("order contains word index %v not present in words", wi)
+		}
+	}
+
+	bm.AndNotRange(0, 1000)
+	if len(bm.order) != 0 || len(bm.words) != 0 {
+		t.Fatalf("AndNotRange covering everything should empty both order and words, got order=%v words=%v", bm.order, bm.words)
+	}
+}
+
+// BenchmarkRangeSparse32k models a sequence whose own ~64 positions are
+// scattered across a 32k-position range shared with other sequences and
+// prior, since-removed turns, the scenario a bitmap index over Simple's mask
+// construction at long context needs to stay fast for. Range only visits
+// the words that actually hold one of those positions, so its cost tracks
+// the handful of occupied words rather than the 512 words begin/end spans.
+func BenchmarkRangeSparse32k(b *testing.B) {
+	const rangeSize = 32768
+	const owned = 64
+
+	bm := newSeqIndex().(*wordBitmap)
+	for i := 0; i < owned; i++ {
+		bm.Set(i * (rangeSize / owned))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		bm.Range(0, rangeSize, func(pos int) { n++ })
+		if n != owned {
+			b.Fatalf("Range visited %v positions, want %v", n, owned)
+		}
+	}
+}
+
+// BenchmarkRangeDense32k is the opposite end of the spectrum - a sequence
+// that owns every position in its range, as a single uninterrupted sequence
+// does in Simple today - included as a baseline so BenchmarkRangeSparse32k's
+// number is read relative to the case where sparsity buys nothing.
+func BenchmarkRangeDense32k(b *testing.B) {
+	const rangeSize = 32768
+
+	bm := newSeqIndex().(*wordBitmap)
+	for i := 0; i < rangeSize; i++ {
+		bm.Set(i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		bm.Range(0, rangeSize, func(pos int) { n++ })
+		if n != rangeSize {
+			b.Fatalf("Range visited %v positions, want %v", n, rangeSize)
+		}
+	}
+}
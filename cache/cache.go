@@ -3,6 +3,8 @@ package cache
 import (
 	"fmt"
 	"math"
+	"runtime"
+	"sync"
 
 	"github.com/ollama/ollama/ml"
 )
@@ -11,25 +13,93 @@ type Options struct {
 	Sequences []int
 }
 
+// PutEntry is one (sequence, key, value) triple passed to LayerCache.PutBatch
+// so unrelated sequences within a layer can be written concurrently instead
+// of forcing every request into a single batched tensor.
+type PutEntry struct {
+	Seq        int
+	Key, Value ml.Tensor
+}
+
+// ForwardState is the position bookkeeping and attention mask produced by
+// StartForward for one forward pass. It used to live directly on Cache and
+// be mutated in place by Sub/Put, which meant a second forward couldn't be
+// prepared until the first had finished executing on the backend. Threading
+// it through explicitly instead means StartForward, Sub and Put no longer
+// share any mutable per-forward state, so independent forwards - and
+// independent layers of the same forward - can run concurrently.
+type ForwardState struct {
+	seqs      []int
+	pos       int
+	batchSize int
+	mask      ml.Tensor
+
+	// slots and evictions are only populated by Sliding: slot assignment,
+	// including which tokens trigger an eviction, has to be decided once
+	// per forward step and shared by every layer's Put call, since all
+	// layers must write a given token to the same physical slot.
+	slots     []int
+	evictions []bool
+	live      int
+}
+
 type Cache interface {
 	Close()
 
-	StartForward(ctx ml.Context, seqs []int) error
+	StartForward(ctx ml.Context, seqs []int) (*ForwardState, error)
 
-	Sub(i int) Cache
-	Put(ctx ml.Context, key, value ml.Tensor, opts Options) (ml.Tensor, ml.Tensor, ml.Tensor)
+	// Sub returns a handle for layer i that PutBatch/Put may be called on.
+	// Handles for different layers are safe to use concurrently from
+	// different goroutines: it won't race or corrupt state. The ctx work
+	// Put/PutBatch do is still serialized cache-wide, though, since they
+	// build onto the single ml.Context shared by the whole forward pass and
+	// nothing about ml.Context says building onto it concurrently is safe -
+	// so calling Put on two layers at once is safe, but doesn't currently
+	// buy any parallelism on that part of the work.
+	Sub(i int) LayerCache
 	Remove(seq int, beginIndex, endIndex int)
 }
 
+// LayerCache is the per-layer handle returned by Cache.Sub.
+type LayerCache interface {
+	Put(state *ForwardState, ctx ml.Context, key, value ml.Tensor, opts Options) (ml.Tensor, ml.Tensor, ml.Tensor)
+
+	// PutBatch writes every entry and returns the resulting key/value views
+	// in entry order. Simple and Sliding fan entries out across a worker
+	// pool sized by GOMAXPROCS; Paged writes them one after another and does
+	// not run them concurrently. entries
+	// must be in the same order as the seqs given to the StartForward call
+	// that produced state.
+	PutBatch(state *ForwardState, ctx ml.Context, entries []PutEntry) (keys, values []ml.Tensor)
+}
+
 type Simple struct {
 	DType    ml.DType
 	Capacity int
 
-	curLayer     int
-	sequences    []int
-	pos          int
-	curBatchSize int
-	mask         ml.Tensor
+	// KeyDType and ValueDType, when QuantizeKeys/QuantizeValues is set,
+	// override DType for the corresponding tensor with a block-quantized
+	// format (e.g. Q8_0, Q4_0) so long contexts use a fraction of the VRAM
+	// an fp16 cache would. Values tolerate aggressive quantization better
+	// than keys, so the two are configured independently.
+	KeyDType       ml.DType
+	ValueDType     ml.DType
+	QuantizeKeys   bool
+	QuantizeValues bool
+
+	// mu guards the state below, which multiple simpleLayer handles and
+	// PutBatch workers may touch concurrently: lazily allocating a layer's
+	// storage tensors, growing keys/values as new layers are seen, and
+	// updating the per-sequence bitmap index.
+	mu     sync.Mutex
+	length int
+	index  map[int]seqIndex
+
+	// ctxMu serializes the ctx.Forward/Copy calls Put makes once mu is
+	// released. Every layer's Put builds onto the single ml.Context shared
+	// by the whole forward pass, so this has to cover direct Put calls
+	// across layers too, not just PutBatch's own fan-out.
+	ctxMu sync.Mutex
 
 	cacheCtx     ml.Context
 	keys, values []ml.Tensor
@@ -44,76 +114,158 @@ func NewSimpleCache(backend ml.Backend, capacity int, dtype ml.DType) Cache {
 	}
 }
 
+// NewQuantizedSimpleCache is like NewSimpleCache but stores keys and/or
+// values in a block-quantized format instead of dtype. Quantization happens
+// as part of the copy into cache storage; the attention kernel reads the
+// quantized layout directly, so no separate dequantize step is needed here.
+func NewQuantizedSimpleCache(backend ml.Backend, capacity int, dtype ml.DType, quantizeKeys bool, keyDType ml.DType, quantizeValues bool, valueDType ml.DType) Cache {
+	return &Simple{
+		Capacity:       capacity,
+		DType:          dtype,
+		KeyDType:       keyDType,
+		ValueDType:     valueDType,
+		QuantizeKeys:   quantizeKeys,
+		QuantizeValues: quantizeValues,
+		// TODO(jessegross): This context is not sized appropriately
+		cacheCtx: backend.NewContext(),
+	}
+}
+
 func (c *Simple) Close() {
 	c.cacheCtx.Close()
 }
 
-func (c *Simple) StartForward(ctx ml.Context, seqs []int) error {
-	c.curBatchSize = len(seqs)
-	c.pos = len(c.sequences)
-	c.sequences = append(c.sequences, seqs...)
+func (c *Simple) StartForward(ctx ml.Context, seqs []int) (*ForwardState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := &ForwardState{
+		seqs:      seqs,
+		pos:       c.length,
+		batchSize: len(seqs),
+	}
 
-	if c.pos+c.curBatchSize >= c.Capacity {
+	if state.pos+state.batchSize >= c.Capacity {
 		panic(fmt.Errorf("context length exceeded (length: %v)", c.Capacity))
 	}
 
+	if c.index == nil {
+		c.index = make(map[int]seqIndex)
+	}
+
+	for i, seq := range seqs {
+		bitmap, ok := c.index[seq]
+		if !ok {
+			bitmap = newSeqIndex()
+			c.index[seq] = bitmap
+		}
+		bitmap.Set(state.pos + i)
+	}
+	c.length = state.pos + state.batchSize
+
 	var err error
-	c.mask, err = c.buildMask(ctx, seqs)
+	state.mask, err = c.buildMask(ctx, state)
 
-	return err
+	return state, err
 }
 
-func (c *Simple) buildMask(ctx ml.Context, seqs []int) (ml.Tensor, error) {
+func (c *Simple) buildMask(ctx ml.Context, state *ForwardState) (ml.Tensor, error) {
 	// TODO(jessegross): This makes a number of simplifications, including assuming
 	// causal attention, no padding, etc.
 
-	curSize := c.pos + c.curBatchSize
-	mask := make([]float32, c.curBatchSize*curSize)
+	curSize := state.pos + state.batchSize
+	mask := make([]float32, state.batchSize*curSize)
 
-	for i := range c.curBatchSize {
-		for j := range curSize {
-			if j > c.pos+i || seqs[i] != c.sequences[j] {
-				mask[i*curSize+j] = float32(math.Inf(-1))
-			}
+	for i := range mask {
+		mask[i] = float32(math.Inf(-1))
+	}
+
+	for i, seq := range state.seqs {
+		if bitmap, ok := c.index[seq]; ok {
+			bitmap.Range(0, state.pos+i+1, func(j int) {
+				mask[i*curSize+j] = 0
+			})
 		}
 	}
 
-	return ctx.FromFloatSlice(mask, curSize, c.curBatchSize)
+	return ctx.FromFloatSlice(mask, curSize, state.batchSize)
 }
 
-func (c *Simple) Sub(i int) Cache {
+func (c *Simple) keyStorageDType() ml.DType {
+	if c.QuantizeKeys {
+		return c.KeyDType
+	}
+	return c.DType
+}
+
+func (c *Simple) valueStorageDType() ml.DType {
+	if c.QuantizeValues {
+		return c.ValueDType
+	}
+	return c.DType
+}
+
+// simpleLayer is the per-layer handle returned by Simple.Sub. It carries no
+// mutable state of its own; everything it touches on the parent cache is
+// guarded by Simple.mu or Simple.ctxMu, so handles for distinct layers can
+// safely be used from distinct goroutines.
+type simpleLayer struct {
+	cache *Simple
+	layer int
+}
+
+func (c *Simple) Sub(i int) LayerCache {
+	c.mu.Lock()
 	if i >= len(c.keys) {
 		c.keys = append(c.keys, make([]ml.Tensor, i-len(c.keys)+1)...)
 		c.values = append(c.values, make([]ml.Tensor, i-len(c.values)+1)...)
 	}
+	c.mu.Unlock()
 
-	c.curLayer = i
-
-	return c
+	return &simpleLayer{cache: c, layer: i}
 }
 
-func (c *Simple) Put(ctx ml.Context, key, value ml.Tensor, opts Options) (ml.Tensor, ml.Tensor, ml.Tensor) {
-	if c.curBatchSize != int(key.Dim(2)) {
-		panic(fmt.Errorf("inconsistent batch sizes (layer: %v, batch size: %v layer batch size: %v)", c.curLayer, c.curBatchSize, int(key.Dim(2))))
+func (l *simpleLayer) ensureStorage(key, value ml.Tensor) {
+	c := l.cache
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.keys[l.layer] == nil || c.values[l.layer] == nil {
+		c.keys[l.layer] = c.cacheCtx.Zeros(c.keyStorageDType(), int(key.Dim(0)*key.Dim(1))*c.Capacity)
+		c.values[l.layer] = c.cacheCtx.Zeros(c.valueStorageDType(), int(value.Dim(0)*value.Dim(1))*c.Capacity)
 	}
+}
 
-	if c.keys[c.curLayer] == nil || c.values[c.curLayer] == nil {
-		c.keys[c.curLayer] = c.cacheCtx.Zeros(c.DType, int(key.Dim(0)*key.Dim(1))*c.Capacity)
-		c.values[c.curLayer] = c.cacheCtx.Zeros(c.DType, int(value.Dim(0)*value.Dim(1))*c.Capacity)
+func (l *simpleLayer) Put(state *ForwardState, ctx ml.Context, key, value ml.Tensor, opts Options) (ml.Tensor, ml.Tensor, ml.Tensor) {
+	c := l.cache
+
+	if state.batchSize != int(key.Dim(2)) {
+		panic(fmt.Errorf("inconsistent batch sizes (layer: %v, batch size: %v layer batch size: %v)", l.layer, state.batchSize, int(key.Dim(2))))
 	}
 
-	ctx.Forward(key.Copy(ctx, c.keys[c.curLayer].View(ctx, int(key.Stride(2))*c.pos, int(key.Dim(0)*key.Dim(1)*key.Dim(2)))))
-	ctx.Forward(value.Copy(ctx, c.values[c.curLayer].View(ctx, int(value.Stride(2))*c.pos, int(value.Dim(0)*value.Dim(1)*value.Dim(2)))))
+	l.ensureStorage(key, value)
+
+	// Everything below touches ctx, which the whole forward pass shares
+	// across every layer, so ctxMu - not mu - has to cover it.
+	c.ctxMu.Lock()
+	defer c.ctxMu.Unlock()
 
-	n := int(key.Dim(2)) + c.pos
+	// When the destination view is a quantized dtype, Copy quantizes into
+	// per-block scales as part of the copy rather than requiring a
+	// separate pass over key/value here.
+	ctx.Forward(key.Copy(ctx, c.keys[l.layer].View(ctx, int(key.Stride(2))*state.pos, int(key.Dim(0)*key.Dim(1)*key.Dim(2)))))
+	ctx.Forward(value.Copy(ctx, c.values[l.layer].View(ctx, int(value.Stride(2))*state.pos, int(value.Dim(0)*value.Dim(1)*value.Dim(2)))))
 
-	key = c.keys[c.curLayer].View(ctx, 0,
+	n := int(key.Dim(2)) + state.pos
+
+	key = c.keys[l.layer].View(ctx, 0,
 		int(key.Dim(0)), int(key.Stride(1)),
 		int(key.Dim(1)), int(key.Stride(2)),
 		n,
 	)
 
-	value = c.values[c.curLayer].View(ctx, 0,
+	value = c.values[l.layer].View(ctx, 0,
 		int(value.Dim(0)), int(value.Stride(1)),
 		int(value.Dim(1)), int(value.Stride(2)),
 		n,
@@ -121,14 +273,65 @@ func (c *Simple) Put(ctx ml.Context, key, value ml.Tensor, opts Options) (ml.Ten
 
 	// TODO shift context if necessary
 
-	return key, value, c.mask
+	return key, value, state.mask
+}
+
+// PutBatch writes each entry's key/value with its own single-sequence Put
+// call, fanned out across a worker pool sized by GOMAXPROCS. Entries must be
+// in the same order as the seqs passed to the StartForward call that
+// produced state, since state.pos+i is what positions entry i. Entries
+// contend on Simple.mu for the lazy storage allocation Put itself already
+// serializes there, and on Simple.ctxMu - which Put also
+// already takes - for the ctx.Forward/Copy graph-building every Put call
+// makes; entries still run on the worker pool so a future ctx that supports
+// building independent subgraphs only needs ctxMu removed, not a restructure.
+func (l *simpleLayer) PutBatch(state *ForwardState, ctx ml.Context, entries []PutEntry) ([]ml.Tensor, []ml.Tensor) {
+	if len(entries) != state.batchSize {
+		panic(fmt.Errorf("entries has %v entries, want %v to match the StartForward batch", len(entries), state.batchSize))
+	}
+
+	keys := make([]ml.Tensor, len(entries))
+	values := make([]ml.Tensor, len(entries))
+
+	sem := make(chan struct{}, max(1, runtime.GOMAXPROCS(0)))
+	var wg sync.WaitGroup
+
+	for i, entry := range entries {
+		if entry.Seq != state.seqs[i] {
+			panic(fmt.Errorf("entries[%v].Seq = %v, want %v to match the StartForward batch order", i, entry.Seq, state.seqs[i]))
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, entry PutEntry) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			entryState := &ForwardState{
+				seqs:      []int{entry.Seq},
+				pos:       state.pos + i,
+				batchSize: 1,
+				mask:      state.mask,
+			}
+
+			k, v, _ := l.Put(entryState, ctx, entry.Key, entry.Value, Options{Sequences: []int{entry.Seq}})
+
+			keys[i], values[i] = k, v
+		}(i, entry)
+	}
+
+	wg.Wait()
+
+	return keys, values
 }
 
 func (c *Simple) Remove(seq int, beginIndex, endIndex int) {
 	// TODO(jessegross): Some models don't support partial erasure
-	for i := beginIndex; i < min(endIndex, len(c.sequences)); i++ {
-		if c.sequences[i] == seq {
-			c.sequences[i] = -1
-		}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if bitmap, ok := c.index[seq]; ok {
+		bitmap.AndNotRange(beginIndex, min(endIndex, c.length))
 	}
 }
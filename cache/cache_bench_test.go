@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// simulatedForwardWork stands in for the cost of one entry's
+// ctx.Forward/Copy calls in simpleLayer.Put. It is NOT a call into
+// simpleLayer.PutBatch and this file never constructs a Simple cache or an
+// ml.Backend, so nothing here exercises PutBatch itself, or measures
+// whether it actually delivers throughput scaling - only the worker-pool
+// scheduling shape it uses around that call, and the effect of serializing
+// it with a mutex the way Simple.ctxMu now does for real (not just as a
+// benchmarking artifact: two layers' Put calls building onto the same
+// ml.Context concurrently would race, so that serialization is a
+// correctness requirement, not a tunable this benchmark is free to relax).
+// A benchmark that actually drives PutBatch needs an ml.Backend, which this
+// package doesn't have available to a test.
+func simulatedForwardWork() {
+	var x int
+	for i := 0; i < 2000; i++ {
+		x += i
+	}
+	_ = x
+}
+
+// BenchmarkSimplePutBatchPoolOverhead measures the worker-pool/mutex pattern
+// simpleLayer.PutBatch uses at increasing entry counts, with
+// simulatedForwardWork standing in for each entry's real ctx work. Because
+// that work is necessarily serialized (see simulatedForwardWork's comment),
+// throughput is expected to stay roughly flat rather than scale with
+// concurrency; this does not show PutBatch itself scaling with entry count,
+// only that the scheduling overhead around the now-required serialization
+// stays cheap. Revisit once ml.Context supports building independent
+// subgraphs per goroutine, at which point the serialization can come out
+// and both this and PutBatch should start scaling.
+func BenchmarkSimplePutBatchPoolOverhead(b *testing.B) {
+	for _, n := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("entries-%d", n), func(b *testing.B) {
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				sem := make(chan struct{}, max(1, runtime.GOMAXPROCS(0)))
+				var wg sync.WaitGroup
+				var ctxMu sync.Mutex
+
+				for range n {
+					wg.Add(1)
+					sem <- struct{}{}
+
+					go func() {
+						defer wg.Done()
+						defer func() { <-sem }()
+
+						ctxMu.Lock()
+						simulatedForwardWork()
+						ctxMu.Unlock()
+					}()
+				}
+
+				wg.Wait()
+			}
+		})
+	}
+}
@@ -0,0 +1,500 @@
+package cache
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/ollama/ollama/ml"
+)
+
+// block is one fixed-size slot of a Paged cache's backing storage. Blocks are
+// owned by zero or more sequences at a time; refCount tracks how many
+// sequences currently reference it so that a shared prompt prefix can be
+// copy-on-written instead of duplicated.
+type block struct {
+	id       int
+	length   int // number of valid tokens currently stored in this block
+	refCount int
+}
+
+// Paged is a Cache implementation that stores each layer's key/value tensors
+// as a pool of fixed-size blocks rather than one contiguous Capacity-sized
+// allocation. Sequences hold an ordered table of block ids instead of a
+// single offset into a flat tensor, so growing a sequence only consumes
+// blocks from a shared free list instead of requiring the worst-case
+// context length to be reserved up front.
+type Paged struct {
+	DType     ml.DType
+	Capacity  int
+	BlockSize int
+
+	// KeyDType and ValueDType override DType for the corresponding storage
+	// tensor when QuantizeKeys/QuantizeValues is set, as in the quantized
+	// Simple cache.
+	KeyDType       ml.DType
+	ValueDType     ml.DType
+	QuantizeKeys   bool
+	QuantizeValues bool
+
+	// mu guards everything below: block allocation/refcounts and the
+	// per-sequence block tables are shared state that pagedLayer handles
+	// for different layers, and PutBatch workers for different sequences,
+	// may touch concurrently.
+	mu sync.Mutex
+
+	// ctxMu serializes the ctx.Forward/Copy/Rows calls Put makes once mu is
+	// released. Every layer's Put builds onto the single ml.Context shared
+	// by the whole forward pass, and nothing about ml.Context says building
+	// onto it concurrently is safe, so this has to cover direct Put calls
+	// across layers too, not just PutBatch's own fan-out.
+	ctxMu sync.Mutex
+
+	numBlocks int
+	blocks    []block
+	freeList  []int
+
+	// blockTables maps a sequence id to the ordered list of block ids that
+	// back its tokens, and seqLens tracks how many tokens that sequence
+	// currently holds across all of its blocks.
+	blockTables map[int][]int
+	seqLens     map[int]int
+
+	cacheCtx     ml.Context
+	keys, values []ml.Tensor
+}
+
+func NewPagedCache(backend ml.Backend, capacity, blockSize int, dtype ml.DType) Cache {
+	return newPagedCache(backend, capacity, blockSize, dtype, false, dtype, false, dtype)
+}
+
+// NewQuantizedPagedCache is like NewPagedCache but stores keys and/or values
+// in a block-quantized format instead of dtype.
+func NewQuantizedPagedCache(backend ml.Backend, capacity, blockSize int, dtype ml.DType, quantizeKeys bool, keyDType ml.DType, quantizeValues bool, valueDType ml.DType) Cache {
+	return newPagedCache(backend, capacity, blockSize, dtype, quantizeKeys, keyDType, quantizeValues, valueDType)
+}
+
+func newPagedCache(backend ml.Backend, capacity, blockSize int, dtype ml.DType, quantizeKeys bool, keyDType ml.DType, quantizeValues bool, valueDType ml.DType) Cache {
+	numBlocks := (capacity + blockSize - 1) / blockSize
+
+	freeList := make([]int, numBlocks)
+	blocks := make([]block, numBlocks)
+	for i := range blocks {
+		blocks[i].id = i
+		freeList[i] = numBlocks - 1 - i
+	}
+
+	return &Paged{
+		Capacity:  capacity,
+		BlockSize: blockSize,
+		DType:     dtype,
+
+		KeyDType:       keyDType,
+		ValueDType:     valueDType,
+		QuantizeKeys:   quantizeKeys,
+		QuantizeValues: quantizeValues,
+
+		numBlocks: numBlocks,
+		blocks:    blocks,
+		freeList:  freeList,
+
+		blockTables: make(map[int][]int),
+		seqLens:     make(map[int]int),
+
+		// TODO(jessegross): This context is not sized appropriately
+		cacheCtx: backend.NewContext(),
+	}
+}
+
+func (c *Paged) Close() {
+	c.cacheCtx.Close()
+}
+
+func (c *Paged) StartForward(ctx ml.Context, seqs []int) (*ForwardState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, seq := range seqs {
+		if c.seqLens[seq] >= c.Capacity {
+			return nil, fmt.Errorf("context length exceeded (length: %v)", c.Capacity)
+		}
+	}
+
+	// A batch can allocate at most one new block per token it contains (the
+	// worst case where every token starts a fresh block for its sequence).
+	// Check that conservative bound here, where StartForward already has a
+	// place to report it as an error, rather than letting Put discover the
+	// pool is exhausted partway through and panic in allocBlock.
+	if len(seqs) > len(c.freeList) {
+		return nil, fmt.Errorf("paged cache exhausted: %v blocks free, batch of %v tokens may need that many", len(c.freeList), len(seqs))
+	}
+
+	state := &ForwardState{seqs: seqs, batchSize: len(seqs)}
+
+	var err error
+	state.mask, err = c.buildMask(ctx, state)
+
+	return state, err
+}
+
+// buildMask assumes, as Simple does, causal attention with no padding. Unlike
+// Simple, positions for different sequences in the batch are not comparable
+// directly against a single global offset, so curSize is the length of the
+// longest sequence touched by this batch and shorter sequences are masked
+// out beyond their own length.
+func (c *Paged) buildMask(ctx ml.Context, state *ForwardState) (ml.Tensor, error) {
+	curSize := 0
+	for _, seq := range state.seqs {
+		if l := c.seqLens[seq] + 1; l > curSize {
+			curSize = l
+		}
+	}
+
+	mask := make([]float32, state.batchSize*curSize)
+
+	for i, seq := range state.seqs {
+		pos := c.seqLens[seq]
+		for j := range curSize {
+			if j > pos {
+				mask[i*curSize+j] = float32(math.Inf(-1))
+			}
+		}
+	}
+
+	return ctx.FromFloatSlice(mask, curSize, state.batchSize)
+}
+
+func (c *Paged) keyStorageDType() ml.DType {
+	if c.QuantizeKeys {
+		return c.KeyDType
+	}
+	return c.DType
+}
+
+func (c *Paged) valueStorageDType() ml.DType {
+	if c.QuantizeValues {
+		return c.ValueDType
+	}
+	return c.DType
+}
+
+// pagedLayer is the per-layer handle returned by Paged.Sub. All the state it
+// touches lives on the parent cache behind Paged.mu and Paged.ctxMu, so
+// handles for distinct layers are safe to use concurrently: mu covers the
+// bookkeeping, ctxMu covers the ctx-building work every Put call makes.
+type pagedLayer struct {
+	cache *Paged
+	layer int
+}
+
+func (c *Paged) Sub(i int) LayerCache {
+	c.mu.Lock()
+	if i >= len(c.keys) {
+		c.keys = append(c.keys, make([]ml.Tensor, i-len(c.keys)+1)...)
+		c.values = append(c.values, make([]ml.Tensor, i-len(c.values)+1)...)
+	}
+	c.mu.Unlock()
+
+	return &pagedLayer{cache: c, layer: i}
+}
+
+// allocBlock pops a block off the shared free list. StartForward already
+// rejects any batch whose worst-case block demand can't be met, so an empty
+// free list here means that check was wrong, not that the caller hit a
+// normal capacity limit; it panics as a backstop invariant rather than as
+// the primary way callers learn the pool is exhausted. Callers must hold
+// c.mu.
+func (c *Paged) allocBlock() int {
+	if len(c.freeList) == 0 {
+		panic(fmt.Errorf("no free blocks available (numBlocks: %v)", c.numBlocks))
+	}
+
+	id := c.freeList[len(c.freeList)-1]
+	c.freeList = c.freeList[:len(c.freeList)-1]
+	c.blocks[id].refCount = 1
+	c.blocks[id].length = 0
+
+	return id
+}
+
+// ownBlockPlan is the bookkeeping ownBlock decided on: dst is the block id
+// the caller should write into, and, if copyLen > 0, the caller must copy
+// copyLen rows from copyFrom into dst to complete the copy-on-write before
+// writing anything new into dst.
+type ownBlockPlan struct {
+	dst      int
+	copyFrom int
+	copyLen  int
+}
+
+// ownBlock decides which block id seq should write into: its current tail
+// block if it isn't shared, or a freshly allocated one otherwise. It only
+// updates bookkeeping (refcounts and seq's block table); the actual
+// copy-on-write copy described by the returned plan is layer-local tensor
+// work the caller performs outside c.mu, so that copy doesn't serialize
+// other layers' Put calls against this one. Callers must hold c.mu.
+func (c *Paged) ownBlock(seq int) ownBlockPlan {
+	table := c.blockTables[seq]
+	last := table[len(table)-1]
+
+	if c.blocks[last].refCount == 1 {
+		return ownBlockPlan{dst: last}
+	}
+
+	id := c.allocBlock()
+	length := c.blocks[last].length
+	c.blocks[id].length = length
+
+	c.blocks[last].refCount--
+	table[len(table)-1] = id
+
+	return ownBlockPlan{dst: id, copyFrom: last, copyLen: length}
+}
+
+func (l *pagedLayer) Put(state *ForwardState, ctx ml.Context, key, value ml.Tensor, opts Options) (ml.Tensor, ml.Tensor, ml.Tensor) {
+	c := l.cache
+
+	if state.batchSize != int(key.Dim(2)) {
+		panic(fmt.Errorf("inconsistent batch sizes (layer: %v, batch size: %v layer batch size: %v)", l.layer, state.batchSize, int(key.Dim(2))))
+	}
+
+	rowSize := int(key.Dim(0) * key.Dim(1))
+
+	// Only the bookkeeping below - block allocation, refcounts, block
+	// tables and seqLens - is shared mutable state across layers, so it's
+	// all c.mu protects. plans records, per token, where it ends up and
+	// what copy-on-write copy (if any) getting there requires; the actual
+	// tensor ops run after c.mu is released, against this layer's own
+	// storage, so distinct layers' Put calls no longer serialize against
+	// each other here the way they would if the lock spanned the whole
+	// method.
+	type writePlan struct {
+		ownBlockPlan
+		slot int
+	}
+
+	c.mu.Lock()
+
+	if c.keys[l.layer] == nil || c.values[l.layer] == nil {
+		c.keys[l.layer] = c.cacheCtx.Zeros(c.keyStorageDType(), int(key.Dim(0)*key.Dim(1))*c.numBlocks*c.BlockSize)
+		c.values[l.layer] = c.cacheCtx.Zeros(c.valueStorageDType(), int(value.Dim(0)*value.Dim(1))*c.numBlocks*c.BlockSize)
+	}
+
+	plans := make([]writePlan, state.batchSize)
+	maxLen := 0
+
+	for i, seq := range state.seqs {
+		table := c.blockTables[seq]
+		if len(table) == 0 || c.blocks[table[len(table)-1]].length == c.BlockSize {
+			table = append(table, c.allocBlock())
+			c.blockTables[seq] = table
+		}
+
+		plan := c.ownBlock(seq)
+		slot := plan.dst*c.BlockSize + c.blocks[plan.dst].length
+		plans[i] = writePlan{ownBlockPlan: plan, slot: slot}
+
+		c.blocks[plan.dst].length++
+		c.seqLens[seq]++
+
+		if c.seqLens[seq] > maxLen {
+			maxLen = c.seqLens[seq]
+		}
+	}
+
+	// Gather the live blocks for the sequences in this batch into a
+	// contiguous view the attention kernel can consume directly. Sequences
+	// sharing a prefix reuse the same block ids here, so no K/V is
+	// duplicated for shared prompt tokens.
+	gather := make([]int32, 0, state.batchSize*maxLen)
+	for _, seq := range state.seqs {
+		for _, id := range c.blockTables[seq] {
+			length := c.blocks[id].length
+			for slot := range length {
+				gather = append(gather, int32(id*c.BlockSize+slot))
+			}
+		}
+	}
+
+	c.mu.Unlock()
+
+	// Everything from here on touches ctx, which the whole forward pass
+	// shares across every layer, so it's ctxMu - not c.mu - that has to
+	// cover it: c.mu is already free for the next layer's bookkeeping by
+	// this point.
+	c.ctxMu.Lock()
+	defer c.ctxMu.Unlock()
+
+	for i, plan := range plans {
+		if plan.copyLen > 0 {
+			ctx.Forward(c.keys[l.layer].View(ctx, plan.copyFrom*c.BlockSize*rowSize, plan.copyLen*rowSize).
+				Copy(ctx, c.keys[l.layer].View(ctx, plan.dst*c.BlockSize*rowSize, plan.copyLen*rowSize)))
+			ctx.Forward(c.values[l.layer].View(ctx, plan.copyFrom*c.BlockSize*rowSize, plan.copyLen*rowSize).
+				Copy(ctx, c.values[l.layer].View(ctx, plan.dst*c.BlockSize*rowSize, plan.copyLen*rowSize)))
+		}
+
+		// As in Simple, Copy quantizes into per-block scales when the
+		// destination view's dtype is a block-quantized format.
+		ctx.Forward(key.View(ctx, i*rowSize, rowSize).Copy(ctx, c.keys[l.layer].View(ctx, plan.slot*rowSize, rowSize)))
+		ctx.Forward(value.View(ctx, i*rowSize, rowSize).Copy(ctx, c.values[l.layer].View(ctx, plan.slot*rowSize, rowSize)))
+	}
+
+	indices, err := ctx.FromIntSlice(gather, len(gather))
+	if err != nil {
+		panic(err)
+	}
+
+	key = c.keys[l.layer].Rows(ctx, indices)
+	value = c.values[l.layer].Rows(ctx, indices)
+
+	return key, value, state.mask
+}
+
+// PutBatch writes each entry with its own single-sequence Put call. Entries
+// are processed sequentially: unlike Simple, block allocation for one entry
+// (a shared prefix losing its last copy-on-write owner, say) can change what
+// the next entry needs to do, so fanning these out would need finer-grained
+// locking than a single c.mu buys us. The worker-pool entry point is kept
+// here for interface parity with Simple and so callers don't need to know
+// which Cache implementation they're batching against.
+func (l *pagedLayer) PutBatch(state *ForwardState, ctx ml.Context, entries []PutEntry) ([]ml.Tensor, []ml.Tensor) {
+	keys := make([]ml.Tensor, len(entries))
+	values := make([]ml.Tensor, len(entries))
+
+	for i, entry := range entries {
+		entryState := &ForwardState{seqs: []int{entry.Seq}, batchSize: 1, mask: state.mask}
+		k, v, _ := l.Put(entryState, ctx, entry.Key, entry.Value, Options{Sequences: []int{entry.Seq}})
+		keys[i], values[i] = k, v
+	}
+
+	return keys, values
+}
+
+// Fork makes dst start from src's current cache contents by copying src's
+// block table and incrementing the refcount of every block it references,
+// instead of duplicating the underlying K/V storage. dst must not already
+// have any cache state of its own. The blocks start out shared: the first
+// write either sequence makes to a shared tail block goes through
+// ownBlock's copy-on-write path, so src and dst diverge safely from there
+// without needing to eagerly copy anything here.
+func (c *Paged) Fork(src, dst int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.blockTables[dst]; exists {
+		return fmt.Errorf("sequence %v already has cache state and cannot be forked into", dst)
+	}
+
+	table := c.blockTables[src]
+	if len(table) == 0 {
+		return fmt.Errorf("sequence %v has no cache state to fork from", src)
+	}
+
+	forked := make([]int, len(table))
+	copy(forked, table)
+	for _, id := range forked {
+		c.blocks[id].refCount++
+	}
+
+	c.blockTables[dst] = forked
+	c.seqLens[dst] = c.seqLens[src]
+
+	return nil
+}
+
+// freeBlocks decrements the refcount of every block id in the slice, and
+// returns any that drop to zero to the shared free list. Blocks still
+// referenced by another sequence (a shared prefix) are left intact. Callers
+// must hold c.mu.
+func (c *Paged) freeBlocks(ids []int) {
+	for _, id := range ids {
+		c.blocks[id].refCount--
+		if c.blocks[id].refCount <= 0 {
+			c.blocks[id].refCount = 0
+			c.blocks[id].length = 0
+			c.freeList = append(c.freeList, id)
+		}
+	}
+}
+
+// Remove drops seq's tokens in [beginIndex, endIndex). Blocks only support
+// being freed as a whole, so this only handles the two removal shapes a
+// block table can represent without shifting any physical storage: a full
+// removal (the whole sequence is being dropped) and a tail truncation
+// (beginIndex > 0, endIndex reaches the end - e.g. rolling back rejected
+// speculative tokens), which frees whichever trailing blocks fall entirely
+// after beginIndex and, if beginIndex doesn't land on a block boundary,
+// trims the one block it splits. A prefix removal (beginIndex == 0, endIndex
+// short of the end) only frees whichever leading blocks fall entirely before
+// endIndex; a block endIndex splits is left intact rather than partially
+// freed, so it can undershoot the requested range by up to BlockSize-1
+// tokens - this cache has no way to renumber the kept blocks' positions (and
+// re-rotate their RoPE phase to match, the way Sliding's shift does) without
+// a ctx this method isn't given, so it never claims to remove more than it
+// safely can.
+func (c *Paged) Remove(seq int, beginIndex, endIndex int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	table := c.blockTables[seq]
+	if len(table) == 0 {
+		return
+	}
+
+	seqLen := c.seqLens[seq]
+	end := min(endIndex, seqLen)
+	if beginIndex >= end {
+		return
+	}
+
+	if beginIndex == 0 && end >= seqLen {
+		c.freeBlocks(table)
+		delete(c.blockTables, seq)
+		delete(c.seqLens, seq)
+		return
+	}
+
+	if end >= seqLen {
+		// Tail truncation: keep every block holding a position before
+		// beginIndex (including the one beginIndex splits), free the rest.
+		keepBlocks := (beginIndex + c.BlockSize - 1) / c.BlockSize
+
+		c.freeBlocks(table[keepBlocks:])
+		table = table[:keepBlocks:keepBlocks]
+		c.blockTables[seq] = table
+
+		last := table[len(table)-1]
+		if keepInLast := beginIndex - (keepBlocks-1)*c.BlockSize; keepInLast < c.blocks[last].length {
+			if c.blocks[last].refCount == 1 {
+				c.blocks[last].length = keepInLast
+			}
+			// Otherwise last is still shared (e.g. via Fork): trimming its
+			// length would also truncate whatever else references it, so
+			// leave it as-is and keep those extra tokens rather than
+			// corrupt another sequence's view.
+		}
+
+		c.seqLens[seq] = (keepBlocks-1)*c.BlockSize + c.blocks[last].length
+		return
+	}
+
+	if beginIndex == 0 {
+		// Prefix removal: only whole blocks entirely before end can be
+		// freed without a physical shift.
+		dropBlocks := end / c.BlockSize
+		if dropBlocks == 0 {
+			return
+		}
+
+		c.freeBlocks(table[:dropBlocks])
+		remaining := make([]int, len(table)-dropBlocks)
+		copy(remaining, table[dropBlocks:])
+		c.blockTables[seq] = remaining
+		c.seqLens[seq] = seqLen - dropBlocks*c.BlockSize
+		return
+	}
+
+	// An interior range - neither a prefix nor a tail - can't be expressed
+	// by dropping whole blocks from either end of the table, so leave it
+	// alone rather than freeing something still referenced by seq.
+}
@@ -0,0 +1,140 @@
+package cache
+
+import "testing"
+
+// TestPagedForkSharesBlocksAndCOWProtectsSource exercises the bookkeeping
+// Fork and ownBlock do without needing a real ml.Backend: both only update
+// block tables and refcounts, leaving the actual copy-on-write tensor copy
+// to the caller, so they can be tested by building a Paged directly from
+// its zero-value-friendly fields.
+func TestPagedForkSharesBlocksAndCOWProtectsSource(t *testing.T) {
+	c := &Paged{
+		BlockSize:   4,
+		blocks:      []block{{id: 0, refCount: 1, length: 4}, {id: 1, refCount: 1}},
+		freeList:    []int{1},
+		blockTables: map[int][]int{0: {0}},
+		seqLens:     map[int]int{0: 4},
+	}
+
+	if err := c.Fork(0, 1); err != nil {
+		t.Fatalf("Fork: %v", err)
+	}
+
+	if got := c.blockTables[1]; len(got) != 1 || got[0] != 0 {
+		t.Fatalf("forked table = %v, want [0]", got)
+	}
+	if c.blocks[0].refCount != 2 {
+		t.Fatalf("block 0 refCount = %v, want 2 after fork", c.blocks[0].refCount)
+	}
+	if c.seqLens[1] != c.seqLens[0] {
+		t.Fatalf("forked seqLen = %v, want %v", c.seqLens[1], c.seqLens[0])
+	}
+	if c.blockTables[0][0] != c.blockTables[1][0] {
+		t.Fatalf("fork duplicated block 0 instead of sharing it")
+	}
+
+	if err := c.Fork(0, 1); err == nil {
+		t.Fatalf("Fork into a sequence that already has cache state should fail")
+	}
+	if err := c.Fork(2, 3); err == nil {
+		t.Fatalf("Fork from a sequence with no cache state should fail")
+	}
+
+	plan := c.ownBlock(1)
+	if plan.dst == c.blockTables[0][0] {
+		t.Fatalf("ownBlock returned the still-shared block instead of copy-on-writing")
+	}
+	if plan.copyFrom != c.blockTables[0][0] || plan.copyLen != 4 {
+		t.Fatalf("ownBlock plan = %+v, want a copy of 4 rows from seq 0's block", plan)
+	}
+
+	if c.blocks[0].refCount != 1 {
+		t.Fatalf("source block refCount = %v, want 1 after seq 1's COW", c.blocks[0].refCount)
+	}
+	if c.blockTables[0][0] != 0 {
+		t.Fatalf("seq 0's block table was mutated by seq 1's write: %v", c.blockTables[0])
+	}
+	if c.blockTables[1][0] != plan.dst {
+		t.Fatalf("seq 1's table still points at the shared block after COW: %v", c.blockTables[1])
+	}
+
+	// seq 0 still owns its original, now-unshared block exclusively.
+	if again := c.ownBlock(0); again.dst != c.blockTables[0][0] || again.copyLen != 0 {
+		t.Fatalf("ownBlock copy-on-wrote a block that was no longer shared: %+v", again)
+	}
+}
+
+// TestPagedRemoveTailTruncationKeepsPrefixReachable covers rolling back
+// rejected tokens off the end of a sequence: only the blocks after
+// beginIndex should be freed, and the table/seqLens left pointing at
+// exactly what's kept.
+func TestPagedRemoveTailTruncationKeepsPrefixReachable(t *testing.T) {
+	c := &Paged{
+		BlockSize:   4,
+		blocks:      []block{{id: 0, refCount: 1, length: 4}, {id: 1, refCount: 1, length: 4}},
+		blockTables: map[int][]int{0: {0, 1}},
+		seqLens:     map[int]int{0: 8},
+	}
+
+	c.Remove(0, 4, 8)
+
+	if got := c.blockTables[0]; len(got) != 1 || got[0] != 0 {
+		t.Fatalf("blockTables[0] = %v, want [0]", got)
+	}
+	if c.seqLens[0] != 4 {
+		t.Fatalf("seqLens[0] = %v, want 4", c.seqLens[0])
+	}
+	if c.blocks[1].refCount != 0 {
+		t.Fatalf("block 1 refCount = %v, want 0 after being freed", c.blocks[1].refCount)
+	}
+	if len(c.freeList) != 1 || c.freeList[0] != 1 {
+		t.Fatalf("freeList = %v, want [1]", c.freeList)
+	}
+
+	// The freed block must be reusable and not corrupt seq 0's surviving
+	// data when it's handed to someone else.
+	id := c.allocBlock()
+	if id != 1 {
+		t.Fatalf("allocBlock() = %v, want the just-freed block 1", id)
+	}
+	if c.blockTables[0][0] != 0 {
+		t.Fatalf("seq 0's surviving block table changed: %v", c.blockTables[0])
+	}
+}
+
+// TestPagedRemovePrefixKeepsSuffixReachable covers dropping the earliest
+// turns of a sequence's context: the leading blocks should be freed and the
+// table/seqLens shrunk to describe only what's left, without deleting the
+// sequence's bookkeeping outright.
+func TestPagedRemovePrefixKeepsSuffixReachable(t *testing.T) {
+	c := &Paged{
+		BlockSize:   4,
+		blocks:      []block{{id: 0, refCount: 1, length: 4}, {id: 1, refCount: 1, length: 4}},
+		blockTables: map[int][]int{0: {0, 1}},
+		seqLens:     map[int]int{0: 8},
+	}
+
+	c.Remove(0, 0, 4)
+
+	if _, ok := c.blockTables[0]; !ok {
+		t.Fatalf("Remove(0, 0, 4) deleted seq 0's bookkeeping instead of keeping the surviving block")
+	}
+	if got := c.blockTables[0]; len(got) != 1 || got[0] != 1 {
+		t.Fatalf("blockTables[0] = %v, want [1]", got)
+	}
+	if c.seqLens[0] != 4 {
+		t.Fatalf("seqLens[0] = %v, want 4", c.seqLens[0])
+	}
+	if c.blocks[0].refCount != 0 {
+		t.Fatalf("block 0 refCount = %v, want 0 after being freed", c.blocks[0].refCount)
+	}
+
+	// A full removal still clears bookkeeping entirely.
+	c.Remove(0, 0, 4)
+	if _, ok := c.blockTables[0]; ok {
+		t.Fatalf("Remove covering everything left over: %v", c.blockTables[0])
+	}
+	if _, ok := c.seqLens[0]; ok {
+		t.Fatalf("seqLens[0] still present after full removal")
+	}
+}
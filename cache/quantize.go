@@ -0,0 +1,65 @@
+package cache
+
+import "math"
+
+// quantizeBlockSize is the number of elements that share one scale, matching
+// the blocking ggml's Q8_0 format uses.
+const quantizeBlockSize = 32
+
+// QuantizeQ8_0 quantizes x in blocks of quantizeBlockSize, returning one
+// float32 scale per block alongside quantizeBlockSize int8 codes per block
+// (the final block is zero-padded if len(x) isn't a multiple of
+// quantizeBlockSize). This is the reference computation the
+// KeyDType/ValueDType=Q8_0 path in Simple and Paged relies on; the backend's
+// Copy kernel performs the same quantization on-device as part of the cache
+// write, so this also gives that behavior something to be tested against
+// off-device.
+func QuantizeQ8_0(x []float32) (scales []float32, codes []int8) {
+	nBlocks := (len(x) + quantizeBlockSize - 1) / quantizeBlockSize
+	scales = make([]float32, nBlocks)
+	codes = make([]int8, nBlocks*quantizeBlockSize)
+
+	for b := range nBlocks {
+		start := b * quantizeBlockSize
+		end := min(start+quantizeBlockSize, len(x))
+
+		var max float32
+		for _, v := range x[start:end] {
+			if a := float32(math.Abs(float64(v))); a > max {
+				max = a
+			}
+		}
+
+		scale := max / 127
+		scales[b] = scale
+
+		for i := start; i < end; i++ {
+			var q float64
+			if scale != 0 {
+				q = math.Round(float64(x[i] / scale))
+			}
+			codes[b*quantizeBlockSize+(i-start)] = int8(q)
+		}
+	}
+
+	return scales, codes
+}
+
+// DequantizeQ8_0 reconstructs the values QuantizeQ8_0 encoded, returning
+// len(codes) float32s (callers that padded the last block should truncate
+// back to their original length themselves).
+func DequantizeQ8_0(scales []float32, codes []int8) []float32 {
+	out := make([]float32, len(codes))
+
+	for b, scale := range scales {
+		for i := 0; i < quantizeBlockSize; i++ {
+			idx := b*quantizeBlockSize + i
+			if idx >= len(codes) {
+				break
+			}
+			out[idx] = float32(codes[idx]) * scale
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestQuantizeQ8_0RoundTripError(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	x := make([]float32, 257) // not a multiple of quantizeBlockSize
+	for i := range x {
+		x[i] = float32(rng.NormFloat64())
+	}
+
+	scales, codes := QuantizeQ8_0(x)
+	got := DequantizeQ8_0(scales, codes)[:len(x)]
+
+	for b := range scales {
+		start := b * quantizeBlockSize
+		end := min(start+quantizeBlockSize, len(x))
+
+		// Quantization error per value is bounded by half a quantization
+		// step (the rounding error introduced by int8(math.Round(...))).
+		tolerance := scales[b]/2 + 1e-6
+
+		for i := start; i < end; i++ {
+			if err := math.Abs(float64(got[i] - x[i])); err > float64(tolerance) {
+				t.Fatalf("value %v: got %v, want within %v of %v (err %v)", i, got[i], tolerance, x[i], err)
+			}
+		}
+	}
+}
+
+func TestQuantizeQ8_0AllZeros(t *testing.T) {
+	x := make([]float32, quantizeBlockSize)
+
+	scales, codes := QuantizeQ8_0(x)
+	if scales[0] != 0 {
+		t.Fatalf("scale for an all-zero block = %v, want 0", scales[0])
+	}
+
+	got := DequantizeQ8_0(scales, codes)
+	for i, v := range got {
+		if v != 0 {
+			t.Fatalf("dequantized value %v = %v, want 0", i, v)
+		}
+	}
+}
+
+func TestQuantizeQ8_0Empty(t *testing.T) {
+	scales, codes := QuantizeQ8_0(nil)
+	if len(scales) != 0 || len(codes) != 0 {
+		t.Fatalf("QuantizeQ8_0(nil) = (%v, %v), want empty", scales, codes)
+	}
+}
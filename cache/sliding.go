@@ -0,0 +1,411 @@
+package cache
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sync"
+
+	"github.com/ollama/ollama/ml"
+)
+
+// Sliding is a Cache implementation for streaming, effectively-infinite
+// generation. Unlike Simple, which panics once the batch would exceed
+// Capacity, Sliding keeps only the most recent Window tokens plus the first
+// AttentionSinks tokens of each sequence (the "attention sink" tokens that
+// StreamingLLM found are disproportionately important to keep, regardless of
+// how far back they are) and evicts everything else. Each sequence gets its
+// own AttentionSinks+Window region, so one sequence's eviction never touches
+// another's tokens and every sequence gets the same retention regardless of
+// how many others share the cache.
+type Sliding struct {
+	DType          ml.DType
+	Window         int
+	AttentionSinks int
+
+	// MaxSequences bounds how many sequences can have a live region in this
+	// cache at once.
+	MaxSequences int
+
+	// mu guards the state below, which is shared by every layer's handle:
+	// slot assignment has to happen once per forward step, consistently
+	// across layers, so a layer can't decide on its own whether the token
+	// it's writing evicted something.
+	mu sync.Mutex
+
+	// ctxMu serializes the ctx.Forward/Copy/RoPEShift calls Put makes.
+	// Every layer's Put builds onto the single ml.Context shared by the
+	// whole forward pass, so - unlike the slot assignment mu guards - this
+	// has to cover direct Put calls across layers too, not just PutBatch's
+	// own fan-out.
+	ctxMu sync.Mutex
+
+	// regions maps a live sequence id to the index of its reserved
+	// capacity()-sized region within sequences/positions; freeRegions holds
+	// region indices a finished sequence gave back via Remove, for reuse by
+	// a new one. filled counts how many of a region's slots are in use,
+	// before the sink+window budget is full and eviction begins.
+	regions     map[int]int
+	filled      map[int]int
+	freeRegions []int
+
+	// sequences and positions describe the live physical slots, grouped by
+	// region in chronological order within that region: the first
+	// AttentionSinks entries of a region (once filled) never move, followed
+	// by that region's own sliding window. positions records each slot's
+	// original absolute position so buildMask can reason about distance
+	// after slots have been evicted and reused.
+	sequences []int
+	positions []int
+	pos       int
+
+	cacheCtx     ml.Context
+	keys, values []ml.Tensor
+}
+
+func NewSlidingCache(backend ml.Backend, window, attentionSinks, maxSequences int, dtype ml.DType) Cache {
+	return &Sliding{
+		Window:         window,
+		AttentionSinks: attentionSinks,
+		MaxSequences:   maxSequences,
+		DType:          dtype,
+
+		regions: make(map[int]int),
+		filled:  make(map[int]int),
+
+		// TODO(jessegross): This context is not sized appropriately
+		cacheCtx: backend.NewContext(),
+	}
+}
+
+func (c *Sliding) Close() {
+	c.cacheCtx.Close()
+}
+
+func (c *Sliding) capacity() int {
+	return c.AttentionSinks + c.Window
+}
+
+func (c *Sliding) StartForward(ctx ml.Context, seqs []int) (*ForwardState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seen := make(map[int]bool, len(seqs))
+	needed := 0
+	for _, seq := range seqs {
+		if _, ok := c.regions[seq]; !ok && !seen[seq] {
+			seen[seq] = true
+			needed++
+		}
+	}
+	if live := len(c.regions) + needed; live > c.MaxSequences {
+		return nil, fmt.Errorf("sliding cache exhausted: %v sequences already live, batch would need room for %v more but MaxSequences is %v", len(c.regions), needed, c.MaxSequences)
+	}
+
+	state := &ForwardState{
+		seqs:      seqs,
+		pos:       c.pos,
+		batchSize: len(seqs),
+		slots:     make([]int, len(seqs)),
+		evictions: make([]bool, len(seqs)),
+	}
+
+	for i, seq := range seqs {
+		slot, evicted := c.assign(seq, state.pos+i)
+		state.slots[i] = slot
+		state.evictions[i] = evicted
+	}
+	c.pos = state.pos + state.batchSize
+	state.live = len(c.sequences)
+
+	var err error
+	state.mask, err = c.buildMask(ctx, state)
+
+	return state, err
+}
+
+// regionFor returns the base offset into sequences/positions reserved for
+// seq, allocating a fresh region (reusing a freed one if available) the
+// first time seq is seen. Callers must hold c.mu and must already have
+// verified room exists via the MaxSequences check in StartForward.
+func (c *Sliding) regionFor(seq int) int {
+	if idx, ok := c.regions[seq]; ok {
+		return idx * c.capacity()
+	}
+
+	var idx int
+	if n := len(c.freeRegions); n > 0 {
+		idx = c.freeRegions[n-1]
+		c.freeRegions = c.freeRegions[:n-1]
+	} else {
+		idx = len(c.regions)
+	}
+	c.regions[seq] = idx
+
+	base := idx * c.capacity()
+	if need := base + c.capacity() - len(c.sequences); need > 0 {
+		c.sequences = append(c.sequences, make([]int, need)...)
+		c.positions = append(c.positions, make([]int, need)...)
+	}
+	for i := base; i < base+c.capacity(); i++ {
+		c.sequences[i] = -1
+	}
+
+	return base
+}
+
+// assign records a newly-arriving token at seq/pos in seq's own region,
+// evicting the oldest token in seq's own window if seq's sink and window
+// regions are already full, and returns the physical slot the token should
+// be written to and whether an eviction occurred. Because every sequence
+// has its own region, one sequence filling its window can never evict
+// another sequence's tokens. Callers must hold c.mu.
+func (c *Sliding) assign(seq, pos int) (slot int, evicted bool) {
+	base := c.regionFor(seq)
+
+	if c.filled[seq] < c.capacity() {
+		slot = base + c.filled[seq]
+		c.sequences[slot] = seq
+		c.positions[slot] = pos
+		c.filled[seq]++
+		return slot, false
+	}
+
+	windowStart := base + c.AttentionSinks
+	shiftCount := c.Window - 1
+
+	copy(c.sequences[windowStart:windowStart+shiftCount], c.sequences[windowStart+1:windowStart+1+shiftCount])
+	copy(c.positions[windowStart:windowStart+shiftCount], c.positions[windowStart+1:windowStart+1+shiftCount])
+
+	slot = windowStart + shiftCount
+	c.sequences[slot] = seq
+	c.positions[slot] = pos
+
+	return slot, true
+}
+
+// buildMask assumes causal attention, no padding, as Simple does. A column
+// is visible to a row if they share a sequence, the column isn't from the
+// future, and the column is either one of the retained sink tokens or still
+// within Window of the row's position. c.sequences/c.positions already
+// reflect this batch's assignment by the time this runs.
+func (c *Sliding) buildMask(ctx ml.Context, state *ForwardState) (ml.Tensor, error) {
+	curSize := len(c.sequences)
+	mask := make([]float32, state.batchSize*curSize)
+
+	for i, seq := range state.seqs {
+		p := state.pos + i
+		base := c.regions[seq] * c.capacity()
+
+		for j := range curSize {
+			colSeq, colPos := c.sequences[j], c.positions[j]
+			visible := colSeq == seq && colPos <= p && (j-base < c.AttentionSinks || p-colPos < c.Window)
+			if !visible {
+				mask[i*curSize+j] = float32(math.Inf(-1))
+			}
+		}
+	}
+
+	return ctx.FromFloatSlice(mask, curSize, state.batchSize)
+}
+
+// slidingLayer is the per-layer handle returned by Sliding.Sub. Slot
+// assignment already happened in StartForward, so Put only needs to move
+// its own layer's physical storage - it never touches the shared slot
+// bookkeeping on Sliding, and the ctx work it does is serialized by
+// Sliding.ctxMu, making handles for distinct layers safe to use
+// concurrently.
+type slidingLayer struct {
+	cache *Sliding
+	layer int
+}
+
+func (c *Sliding) Sub(i int) LayerCache {
+	c.mu.Lock()
+	if i >= len(c.keys) {
+		c.keys = append(c.keys, make([]ml.Tensor, i-len(c.keys)+1)...)
+		c.values = append(c.values, make([]ml.Tensor, i-len(c.values)+1)...)
+	}
+	c.mu.Unlock()
+
+	return &slidingLayer{cache: c, layer: i}
+}
+
+func (l *slidingLayer) Put(state *ForwardState, ctx ml.Context, key, value ml.Tensor, opts Options) (ml.Tensor, ml.Tensor, ml.Tensor) {
+	c := l.cache
+
+	if state.batchSize != int(key.Dim(2)) {
+		panic(fmt.Errorf("inconsistent batch sizes (layer: %v, batch size: %v layer batch size: %v)", l.layer, state.batchSize, int(key.Dim(2))))
+	}
+
+	c.mu.Lock()
+	if c.keys[l.layer] == nil || c.values[l.layer] == nil {
+		c.keys[l.layer] = c.cacheCtx.Zeros(c.DType, int(key.Dim(0)*key.Dim(1))*c.capacity()*c.MaxSequences)
+		c.values[l.layer] = c.cacheCtx.Zeros(c.DType, int(value.Dim(0)*value.Dim(1))*c.capacity()*c.MaxSequences)
+	}
+	c.mu.Unlock()
+
+	rowSize := int(key.Dim(0) * key.Dim(1))
+
+	c.ctxMu.Lock()
+	defer c.ctxMu.Unlock()
+
+	for i := range state.batchSize {
+		if state.evictions[i] {
+			// An evicting token always lands in the last slot of its
+			// region, so the region base follows from the slot alone.
+			c.shift(ctx, l.layer, state.slots[i]-(c.capacity()-1), rowSize)
+		}
+
+		slot := state.slots[i]
+
+		ctx.Forward(key.View(ctx, i*rowSize, rowSize).Copy(ctx, c.keys[l.layer].View(ctx, slot*rowSize, rowSize)))
+		ctx.Forward(value.View(ctx, i*rowSize, rowSize).Copy(ctx, c.values[l.layer].View(ctx, slot*rowSize, rowSize)))
+	}
+
+	key = c.keys[l.layer].View(ctx, 0,
+		int(key.Dim(0)), int(key.Stride(1)),
+		int(key.Dim(1)), int(key.Stride(2)),
+		state.live,
+	)
+
+	value = c.values[l.layer].View(ctx, 0,
+		int(value.Dim(0)), int(value.Stride(1)),
+		int(value.Dim(1)), int(value.Stride(2)),
+		state.live,
+	)
+
+	return key, value, state.mask
+}
+
+// PutBatch writes each entry with its own single-token Put call. Sliding's
+// eviction bookkeeping is already resolved per-position in StartForward
+// (state.slots/state.evictions) and keyed by index, so entries must be in
+// the same order as the seqs passed to that StartForward call; fan them out
+// across a worker pool the same way Simple does, relying on Put's own
+// ctxMu to serialize the shift-and-copy into this layer's storage that
+// every entry shares.
+func (l *slidingLayer) PutBatch(state *ForwardState, ctx ml.Context, entries []PutEntry) ([]ml.Tensor, []ml.Tensor) {
+	if len(entries) != state.batchSize {
+		panic(fmt.Errorf("entries has %v entries, want %v to match the StartForward batch", len(entries), state.batchSize))
+	}
+
+	keys := make([]ml.Tensor, len(entries))
+	values := make([]ml.Tensor, len(entries))
+
+	sem := make(chan struct{}, max(1, runtime.GOMAXPROCS(0)))
+	var wg sync.WaitGroup
+
+	for i, entry := range entries {
+		if entry.Seq != state.seqs[i] {
+			panic(fmt.Errorf("entries[%v].Seq = %v, want %v to match the StartForward batch order", i, entry.Seq, state.seqs[i]))
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, entry PutEntry) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			entryState := &ForwardState{
+				seqs:      []int{entry.Seq},
+				pos:       state.pos + i,
+				batchSize: 1,
+				mask:      state.mask,
+				slots:     []int{state.slots[i]},
+				evictions: []bool{state.evictions[i]},
+				live:      state.live,
+			}
+
+			k, v, _ := l.Put(entryState, ctx, entry.Key, entry.Value, Options{Sequences: []int{entry.Seq}})
+
+			keys[i], values[i] = k, v
+		}(i, entry)
+	}
+
+	wg.Wait()
+
+	return keys, values
+}
+
+// shift evicts the oldest window token from seq's own region of layer's
+// storage by moving the remaining window keys/values down one slot and
+// re-rotating the shifted keys so their rotary phase matches their new,
+// one-lower effective position. base is the start of seq's region.
+func (c *Sliding) shift(ctx ml.Context, layer, base, rowSize int) {
+	windowStart := base + c.AttentionSinks
+	shiftCount := c.Window - 1
+
+	if shiftCount <= 0 {
+		return
+	}
+
+	off := windowStart * rowSize
+	size := shiftCount * rowSize
+
+	ctx.Forward(c.keys[layer].View(ctx, off+rowSize, size).Copy(ctx, c.keys[layer].View(ctx, off, size)))
+	ctx.Forward(c.values[layer].View(ctx, off+rowSize, size).Copy(ctx, c.values[layer].View(ctx, off, size)))
+	ctx.Forward(c.keys[layer].View(ctx, off, size).RoPEShift(ctx, -1))
+}
+
+// Remove drops seq's tokens with an absolute position in [beginIndex,
+// endIndex) - the same position scale StartForward/assign use, not an offset
+// into seq's physical slots, since a sequence that has evicted anything
+// holds real positions far past its region's own capacity(). assign only
+// ever appends at the end of a region or shifts the whole window down by
+// one, so the live slots [base, base+filled[seq]) are always sorted by
+// position ascending, and the removed span is therefore a single contiguous
+// run within them.
+func (c *Sliding) Remove(seq int, beginIndex, endIndex int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	idx, ok := c.regions[seq]
+	if !ok {
+		return
+	}
+	base := idx * c.capacity()
+	n := c.filled[seq]
+
+	first, last := -1, -1
+	for i := base; i < base+n; i++ {
+		if pos := c.positions[i]; pos >= beginIndex && pos < endIndex {
+			if first == -1 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first == -1 {
+		return
+	}
+
+	if first == base && last == base+n-1 {
+		// Every live slot was in range: free the whole region.
+		delete(c.regions, seq)
+		delete(c.filled, seq)
+		c.freeRegions = append(c.freeRegions, idx)
+		return
+	}
+
+	if last == base+n-1 {
+		// Tail truncation: the removed span reaches the newest live slot,
+		// so nothing after it needs to move - forget the tail and let
+		// assign reuse these slots the normal way.
+		for i := first; i <= last; i++ {
+			c.sequences[i] = -1
+		}
+		c.filled[seq] = first - base
+		return
+	}
+
+	// An interior or prefix-only removal: closing the gap would mean
+	// physically shifting the corresponding K/V rows too, which Remove has
+	// no ctx to do. Mark the slots unused so buildMask stops surfacing
+	// them, but leave filled and the rest of the region alone rather than
+	// discarding the newer tokens after the removed span.
+	for i := first; i <= last; i++ {
+		c.sequences[i] = -1
+	}
+}
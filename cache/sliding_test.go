@@ -0,0 +1,178 @@
+package cache
+
+import "testing"
+
+// TestSlidingAssignIsolatesSequences exercises the per-sequence region
+// bookkeeping in assign directly, without a real ml.Backend: a busy
+// sequence filling and evicting its own window must never touch another
+// sequence's slots or shrink its retention.
+func TestSlidingAssignIsolatesSequences(t *testing.T) {
+	c := &Sliding{
+		Window:         2,
+		AttentionSinks: 1,
+		MaxSequences:   2,
+		regions:        make(map[int]int),
+		filled:         make(map[int]int),
+	}
+
+	// Fill sequence 0's entire sink+window region (capacity 3).
+	for pos := range 3 {
+		if _, evicted := c.assign(0, pos); evicted {
+			t.Fatalf("assign(0, %v) evicted before seq 0's own region was full", pos)
+		}
+	}
+
+	base0 := c.regions[0] * c.capacity()
+	before := append([]int(nil), c.positions[base0:base0+c.capacity()]...)
+
+	// Now drive sequence 1 through several evictions. None of this should
+	// touch sequence 0's region.
+	for pos := range 5 {
+		c.assign(1, pos)
+	}
+
+	after := c.positions[base0 : base0+c.capacity()]
+	for i := range before {
+		if after[i] != before[i] {
+			t.Fatalf("seq 0's region changed after seq 1's traffic: before=%v after=%v", before, after)
+		}
+	}
+	for i := base0; i < base0+c.capacity(); i++ {
+		if c.sequences[i] != 0 {
+			t.Fatalf("slot %v in seq 0's region now belongs to seq %v", i, c.sequences[i])
+		}
+	}
+
+	// Sequence 0 should still evict within its own region when it keeps
+	// generating, independent of sequence 1 having used up its own window.
+	slot, evicted := c.assign(0, 3)
+	if !evicted {
+		t.Fatalf("assign(0, 3) should evict once seq 0's own region is full")
+	}
+	if slot < base0 || slot >= base0+c.capacity() {
+		t.Fatalf("eviction for seq 0 wrote outside its own region: slot=%v region=[%v,%v)", slot, base0, base0+c.capacity())
+	}
+
+	// A third sequence should be rejected once MaxSequences regions are
+	// already claimed by 0 and 1 (checked in StartForward, but regionFor
+	// itself will happily keep growing past MaxSequences if a caller
+	// bypasses that check, so verify assign never allocates a 3rd region
+	// as long as StartForward's bound is respected by a caller who used
+	// exactly MaxSequences distinct ids).
+	if len(c.regions) != 2 {
+		t.Fatalf("len(c.regions) = %v, want 2 (one each for seq 0 and seq 1)", len(c.regions))
+	}
+}
+
+func TestSlidingRemoveFreesRegionForReuse(t *testing.T) {
+	c := &Sliding{
+		Window:         2,
+		AttentionSinks: 1,
+		MaxSequences:   1,
+		regions:        make(map[int]int),
+		filled:         make(map[int]int),
+	}
+
+	c.assign(0, 0)
+	if len(c.freeRegions) != 0 {
+		t.Fatalf("freeRegions = %v before any Remove", c.freeRegions)
+	}
+
+	c.Remove(0, 0, c.capacity())
+	if _, ok := c.regions[0]; ok {
+		t.Fatalf("seq 0 still has a region after a full Remove")
+	}
+	if len(c.freeRegions) != 1 {
+		t.Fatalf("freeRegions = %v, want the freed region back", c.freeRegions)
+	}
+
+	// A new sequence should be able to reuse the freed region instead of
+	// being rejected for exceeding MaxSequences.
+	c.assign(1, 0)
+	if _, ok := c.regions[1]; !ok {
+		t.Fatalf("seq 1 could not claim the region seq 0 freed")
+	}
+}
+
+// TestSlidingRemoveTailTruncationUsesAbsolutePositions covers rolling back
+// generation on a sequence whose physical slot indices no longer line up with
+// its positions: the window slots hold positions 100-103, as they would after
+// a run of evictions, although this test fills the region without evicting.
+// The removed range is given in the same absolute position scale StartForward
+// uses, not as an offset into the region's physical slots, so a truncation
+// like "back to real position 50" must still work.
+func TestSlidingRemoveTailTruncationUsesAbsolutePositions(t *testing.T) {
+	c := &Sliding{
+		Window:         4,
+		AttentionSinks: 2,
+		MaxSequences:   1,
+		regions:        make(map[int]int),
+		filled:         make(map[int]int),
+	}
+
+	for _, pos := range []int{0, 1, 100, 101, 102, 103} {
+		c.assign(0, pos)
+	}
+
+	c.Remove(0, 50, 9999)
+
+	base := c.regions[0] * c.capacity()
+	if _, ok := c.regions[0]; !ok {
+		t.Fatalf("seq 0's region was freed, want it kept since positions 0 and 1 survive")
+	}
+	if c.filled[0] != 2 {
+		t.Fatalf("filled[0] = %v, want 2 (positions 0 and 1 kept)", c.filled[0])
+	}
+	for i, want := range []int{0, 1} {
+		if c.positions[base+i] != want || c.sequences[base+i] != 0 {
+			t.Fatalf("slot %v = (seq %v, pos %v), want (seq 0, pos %v)", i, c.sequences[base+i], c.positions[base+i], want)
+		}
+	}
+
+	// A new token should reuse the freed tail slots the normal way.
+	slot, evicted := c.assign(0, 200)
+	if evicted {
+		t.Fatalf("assign after Remove froze the tail slots evicted instead of reusable")
+	}
+	if slot != base+2 {
+		t.Fatalf("assign after Remove wrote to slot %v, want %v (first freed tail slot)", slot, base+2)
+	}
+}
+
+// TestSlidingRemovePrefixKeepsNewerTokens covers dropping the earliest
+// positions of a sequence while keeping newer ones: unlike the tail-reaching
+// case, this must not free the whole region just because beginIndex is 0.
+func TestSlidingRemovePrefixKeepsNewerTokens(t *testing.T) {
+	c := &Sliding{
+		Window:         4,
+		AttentionSinks: 2,
+		MaxSequences:   1,
+		regions:        make(map[int]int),
+		filled:         make(map[int]int),
+	}
+
+	for _, pos := range []int{0, 1, 2, 3} {
+		c.assign(0, pos)
+	}
+
+	c.Remove(0, 0, 2)
+
+	if _, ok := c.regions[0]; !ok {
+		t.Fatalf("seq 0's region was freed, want it kept since positions 2 and 3 survive")
+	}
+	if c.filled[0] != 4 {
+		t.Fatalf("filled[0] = %v, want unchanged at 4 (positions 2,3 stay put, just holes at 0,1)", c.filled[0])
+	}
+
+	base := c.regions[0] * c.capacity()
+	for i, pos := range []int{0, 1} {
+		if c.sequences[base+i] != -1 {
+			t.Fatalf("slot for removed position %v still live: seq=%v", pos, c.sequences[base+i])
+		}
+	}
+	for i, pos := range []int{2, 3} {
+		if c.sequences[base+i] != 0 || c.positions[base+i] != pos {
+			t.Fatalf("slot for kept position %v = (seq %v, pos %v), want (seq 0, pos %v)", pos, c.sequences[base+i], c.positions[base+i], pos)
+		}
+	}
+}